@@ -41,6 +41,25 @@ func main() {
 		return
 	}
 
+	if opts.Command == "prune" {
+		dc, err := cache.NewDiskCache(opts.CacheDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		removed, freed, err := dc.Prune(context.Background(), cache.PruneOptions{
+			MaxBytes:   int64(opts.PruneMaxBytes),
+			MaxAge:     opts.PruneMaxAge,
+			KeepLatest: opts.PruneKeepLatest,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("cache pruned: %d entries removed, %d bytes freed\n", removed, freed)
+		return
+	}
+
 	// For now, just confirm parsed options; server implementation follows in next steps
 	fmt.Printf("starting caching-proxy on :%d forwarding to %s (cache-dir=%s)\n", opts.Port, opts.Origin, opts.CacheDir)
 
@@ -55,8 +74,24 @@ func main() {
 		os.Exit(1)
 	}
 
-	debug := opts.LogLevel == "debug"
-	if err := proxy.Run(ctx, opts.Port, opts.Origin, dc, debug); err != nil {
+	cfg := proxy.Config{
+		Port:             opts.Port,
+		OriginBase:       opts.Origin,
+		Cache:            dc,
+		Debug:            opts.LogLevel == "debug",
+		CoalesceTimeout:  opts.CoalesceTimeout,
+		MaxCoalesceBody:  int64(opts.MaxCoalesceBody),
+		MaxCacheableBody: int64(opts.MaxCacheableBody),
+		StreamThreshold:  int64(opts.StreamThreshold),
+		GCInterval:       opts.GCInterval,
+		GCMaxBytes:       int64(opts.GCMaxBytes),
+		GCMaxAge:         opts.GCMaxAge,
+		GCKeepLatest:     opts.GCKeepLatest,
+		AdminAddr:        opts.AdminAddr,
+		AdminToken:       opts.AdminToken,
+		Rules:            opts.Rules,
+	}
+	if err := proxy.Run(ctx, cfg); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -1,33 +1,154 @@
 package cache
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
-// Entry represents a cached HTTP response.
-type Entry struct {
+// EntryMeta is the metadata stored for a cached HTTP response. The body
+// itself is kept separately on disk and streamed via Get/Set so large
+// responses never have to be held in memory whole.
+type EntryMeta struct {
 	Status int
 	Header http.Header
-	Body   []byte
+
+	// StoredAt is when this entry was written, or last refreshed by a
+	// successful revalidation.
+	StoredAt time.Time
+
+	// RequestHeaders holds the subset of the original request's headers named
+	// by the response's Vary header, captured at store time so later code
+	// can tell which representation this entry is without recomputing it
+	// from the variant index.
+	RequestHeaders http.Header
+
+	// URL is the full origin URL this entry was fetched from, recorded for
+	// admin introspection (e.g. purging by URL). It plays no part in key
+	// computation.
+	URL string
+
+	// Size is the stored body's length in bytes. DiskCache.Set fills this in
+	// once the body has been written, so callers constructing a new
+	// EntryMeta don't need to know it in advance.
+	Size int64
+
+	// PolicyTTL, if non-nil, overrides the freshness lifetime that would
+	// otherwise be computed from the response's own Cache-Control/Expires
+	// headers. Set when a cache-rules rule specifies an explicit ttl.
+	PolicyTTL *time.Duration
+}
+
+// VariantIndex records, for a given URL+method, which request headers the
+// origin's Vary response header names, plus the cache keys already stored
+// for the representations seen so far.
+type VariantIndex struct {
+	// Vary is the list of header names the origin asked us to vary on.
+	Vary []string `json:"vary"`
+	// Variants maps a vary fingerprint (see FingerprintVary) to the cache key
+	// storing that representation.
+	Variants map[string]string `json:"variants"`
 }
 
-// Cache defines the interface for a response cache.
+// Cache defines the interface for a response cache. Bodies are streamed
+// rather than held in memory: Set consumes body from an io.Reader, and Get
+// returns one for the caller to read and close.
 type Cache interface {
-	Get(key string) (*Entry, bool, error)
-	Set(key string, e *Entry) error
+	// Get returns the entry for key, if present, along with a reader for its
+	// body. The caller must close the reader.
+	Get(key string) (*EntryMeta, io.ReadCloser, bool, error)
+	// Set stores meta and streams body to disk under key, replacing any
+	// existing entry. It consumes body fully (or returns an error) before
+	// returning.
+	Set(key string, meta *EntryMeta, body io.Reader) error
+	// UpdateMeta rewrites an existing entry's metadata (e.g. after a 304
+	// revalidation) without touching its stored body.
+	UpdateMeta(key string, meta *EntryMeta) error
 	Delete(key string) error
 	Clear() (int, error) // returns number of entries removed
+
+	// VariantIndex returns the known Vary information for a URL+method, if any.
+	VariantIndex(urlKey string) (*VariantIndex, bool, error)
+	// SaveVariantIndex persists the Vary information for a URL+method.
+	SaveVariantIndex(urlKey string, idx *VariantIndex) error
+
+	// Prune evicts entries until the cache satisfies opts's size/age budgets,
+	// evicting least-recently-used entries first, and reports what it removed.
+	Prune(ctx context.Context, opts PruneOptions) (removed int, freed int64, err error)
+
+	// Iterate calls fn for every stored entry, in unspecified order, until fn
+	// returns false or every entry has been visited.
+	Iterate(fn func(key string, meta EntryMeta) bool) error
+	// Stats reports the cache's on-disk footprint.
+	Stats() (Stats, error)
 }
 
-// BuildCacheKey returns a deterministic key for a request based on method, full URL, and Accept.
-// Avoid caching when Authorization header is present (handled by caller, not here).
-func BuildCacheKey(originBase string, r *http.Request) (string, error) {
+// Stats summarizes a cache's on-disk footprint.
+type Stats struct {
+	Entries int
+	Bytes   int64
+}
+
+// defaultCacheableStatuses are cached even without an explicit
+// "Cache-Control: public, max-age=..." from the origin, per RFC 7231 §6.1's
+// heuristically-cacheable list.
+var defaultCacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// IsCacheableStatus reports whether a response with the given status and
+// headers may be stored. Statuses outside the heuristically-cacheable set are
+// still cacheable if the response explicitly opts in via
+// "Cache-Control: public" together with a max-age/s-maxage or Expires.
+func IsCacheableStatus(status int, header http.Header) bool {
+	if defaultCacheableStatuses[status] {
+		return true
+	}
+	cc := ParseCacheControl(header)
+	if !cc.Public {
+		return false
+	}
+	if cc.MaxAge != nil || cc.SMaxAge != nil {
+		return true
+	}
+	return header.Get("Expires") != ""
+}
+
+// HashURL returns a deterministic key for a request's method and full origin
+// URL, ignoring any Vary-dependent headers. It is the cache key to use when
+// the origin has not declared a Vary header, and the base key VaryKey
+// derives variant keys from.
+func HashURL(originBase string, r *http.Request) (string, error) {
+	return HashURLWithPolicy(originBase, r, QueryPolicy{})
+}
+
+// QueryPolicy customizes which of a request's query parameters participate
+// in its cache key, as directed by a matched cache-rules rule: if VaryQuery
+// is set, only those parameters are kept; otherwise every parameter is kept
+// except those named in IgnoreQuery.
+type QueryPolicy struct {
+	VaryQuery   []string
+	IgnoreQuery []string
+}
+
+// HashURLWithPolicy is like HashURL, but canonicalizes the request's query
+// string per policy first (see CanonicalizeQuery) so that cache-rules
+// vary_query/ignore_query directives produce stable, shared keys for
+// requests that should hit the same entry.
+func HashURLWithPolicy(originBase string, r *http.Request, policy QueryPolicy) (string, error) {
 	base, err := url.Parse(originBase)
 	if err != nil {
 		return "", err
@@ -35,14 +156,122 @@ func BuildCacheKey(originBase string, r *http.Request) (string, error) {
 	// Construct full URL as seen by origin
 	u := *base
 	u.Path = singleJoiningSlash(base.Path, r.URL.Path)
-	u.RawQuery = r.URL.RawQuery
+	u.RawQuery = CanonicalizeQuery(r.URL.RawQuery, policy)
 
-	accept := r.Header.Get("Accept")
-	keyMaterial := strings.Join([]string{r.Method, u.String(), accept}, "\n")
+	keyMaterial := r.Method + "\n" + u.String()
 	h := sha256.Sum256([]byte(keyMaterial))
 	return hex.EncodeToString(h[:]), nil
 }
 
+// CanonicalizeQuery rewrites rawQuery per policy and sorts the surviving
+// parameters by name, so two requests that should be treated as the same
+// representation hash to the same key regardless of parameter order. If
+// policy.VaryQuery is set, only those parameters are kept; otherwise every
+// parameter is kept except those named in policy.IgnoreQuery.
+func CanonicalizeQuery(rawQuery string, policy QueryPolicy) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+
+	keep := make(url.Values, len(values))
+	if len(policy.VaryQuery) > 0 {
+		for _, name := range policy.VaryQuery {
+			if v, ok := values[name]; ok {
+				keep[name] = v
+			}
+		}
+	} else {
+		ignore := make(map[string]bool, len(policy.IgnoreQuery))
+		for _, name := range policy.IgnoreQuery {
+			ignore[name] = true
+		}
+		for name, v := range values {
+			if !ignore[name] {
+				keep[name] = v
+			}
+		}
+	}
+	return keep.Encode() // url.Values.Encode sorts by key
+}
+
+// JoinPath mirrors net/http/httputil's path-joining behavior for combining
+// an origin base path with a request path.
+func JoinPath(a, b string) string {
+	return singleJoiningSlash(a, b)
+}
+
+// FingerprintVary hashes the request header values named by vary, in a
+// canonical order, so two requests agreeing on those values map to the same
+// stored representation.
+func FingerprintVary(vary []string, header http.Header) string {
+	names := make([]string, len(vary))
+	copy(names, vary)
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteByte('=')
+		b.WriteString(header.Get(name))
+		b.WriteByte('\n')
+	}
+	h := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(h[:])
+}
+
+// VaryKey derives the cache key for a particular representation of urlKey,
+// given the Vary header names the origin declared and the request headers to
+// fingerprint against them.
+func VaryKey(urlKey string, vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return urlKey
+	}
+	h := sha256.Sum256([]byte(urlKey + "\n" + FingerprintVary(vary, header)))
+	return hex.EncodeToString(h[:])
+}
+
+// VaryHeaders parses a Vary response header into the request header names it
+// names. A Vary of "*" means every request is its own representation; see
+// VaryAll for how callers must treat that case.
+func VaryHeaders(vary string) []string {
+	if vary == "" {
+		return nil
+	}
+	parts := strings.Split(vary, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		name := strings.TrimSpace(p)
+		if name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// VaryAll reports whether a parsed Vary header is the special "*" value. Per
+// RFC 7234 §4.1, a stored response varying on "*" must never be used to
+// satisfy a later request, so callers must not store it in the first place.
+func VaryAll(vary []string) bool {
+	for _, v := range vary {
+		if v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// SubsetHeaders returns a copy of h containing only the named headers.
+func SubsetHeaders(h http.Header, names []string) http.Header {
+	out := make(http.Header, len(names))
+	for _, name := range names {
+		if v, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			out[http.CanonicalHeaderKey(name)] = append([]string(nil), v...)
+		}
+	}
+	return out
+}
+
 // ShardPath returns a safe relative file path to store the key's payload on disk.
 // Example: ab/cd/abcdef... where first two bytes form first dir, next two for second, etc.
 func ShardPath(cacheDir, key string) string {
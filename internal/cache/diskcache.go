@@ -6,14 +6,26 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
-// DiskCache stores cache entries as JSON files on disk.
-// It is safe for concurrent use.
+// errStopIteration signals Iterate's filepath.Walk to stop early because the
+// caller's callback returned false; it never escapes Iterate itself.
+var errStopIteration = errors.New("stop iteration")
+
+// DiskCache stores cache entry metadata and bodies as separate files on
+// disk, sharded by key. It is safe for concurrent use.
 type DiskCache struct {
 	dir   string
 	locks sync.Map // map[key]*sync.Mutex
+
+	// indexMu guards index.jsonl, the append-only log of IndexEntry records
+	// Prune uses to decide what to evict.
+	indexMu sync.Mutex
+	// pendingAccess buffers Get's LastAccess bumps (map[key]time.Time) until
+	// the next Prune compacts them into the index, so reads stay cheap.
+	pendingAccess sync.Map
 }
 
 // NewDiskCache initializes a disk-backed cache at the given directory, creating it if needed.
@@ -27,9 +39,27 @@ func NewDiskCache(dir string) (*DiskCache, error) {
 	return &DiskCache{dir: dir}, nil
 }
 
-func (c *DiskCache) filePathForKey(key string) string {
-	base := ShardPath(c.dir, key)
-	return base + ".json"
+func (c *DiskCache) metaPath(key string) string {
+	return ShardPath(c.dir, key) + ".meta.json"
+}
+
+func (c *DiskCache) bodyPath(key string) string {
+	return ShardPath(c.dir, key) + ".body"
+}
+
+func (c *DiskCache) variantIndexPath(urlKey string) string {
+	base := ShardPath(c.dir, urlKey)
+	return base + ".vary.json"
+}
+
+// relBodyPath returns key's body path relative to the cache directory, for
+// recording in the index so it stays valid if the cache is relocated.
+func (c *DiskCache) relBodyPath(key string) string {
+	rel, err := filepath.Rel(c.dir, c.bodyPath(key))
+	if err != nil {
+		return c.bodyPath(key)
+	}
+	return rel
 }
 
 func (c *DiskCache) lockFor(key string) *sync.Mutex {
@@ -37,47 +67,132 @@ func (c *DiskCache) lockFor(key string) *sync.Mutex {
 	return muAny.(*sync.Mutex)
 }
 
-// Get retrieves the cached entry for key.
-func (c *DiskCache) Get(key string) (*Entry, bool, error) {
-	path := c.filePathForKey(key)
-	f, err := os.Open(path)
+// Get returns the metadata and a reader for the body stored under key. The
+// caller must close the returned reader.
+func (c *DiskCache) Get(key string) (*EntryMeta, io.ReadCloser, bool, error) {
+	data, err := os.ReadFile(c.metaPath(key))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, false, nil
+			return nil, nil, false, nil
 		}
-		return nil, false, err
+		return nil, nil, false, err
 	}
-	defer f.Close()
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return nil, false, err
+	var meta EntryMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, nil, false, err
 	}
-	var e Entry
-	if err := json.Unmarshal(data, &e); err != nil {
-		return nil, false, err
+	body, err := os.Open(c.bodyPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, false, nil
+		}
+		return nil, nil, false, err
 	}
-	return &e, true, nil
+	c.recordAccess(key)
+	return &meta, body, true, nil
 }
 
-// Set writes the entry for key atomically.
-func (c *DiskCache) Set(key string, e *Entry) error {
-	if e == nil {
-		return errors.New("nil entry")
+// Set streams body into a temp file under key's shard, then atomically
+// renames it into place before writing meta, so a reader never sees a meta
+// file without its matching body. If body can't be fully read, the partial
+// temp file is discarded and the existing entry (if any) is left untouched.
+func (c *DiskCache) Set(key string, meta *EntryMeta, body io.Reader) error {
+	if meta == nil {
+		return errors.New("nil entry meta")
 	}
-	path := c.filePathForKey(key)
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	bodyPath := c.bodyPath(key)
+	dir := filepath.Dir(bodyPath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return err
 	}
 
+	// The index record is appended only after mu is released: Prune holds
+	// indexMu while taking key locks, so the reverse order would deadlock.
+	var indexed *IndexEntry
+	defer func() {
+		if indexed != nil {
+			_ = c.appendIndexEntry(*indexed)
+		}
+	}()
 	mu := c.lockFor(key)
 	mu.Lock()
 	defer mu.Unlock()
 
-	b, err := json.Marshal(e)
+	tmp, err := os.CreateTemp(dir, ".body-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	n, err := io.Copy(tmp, body)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, bodyPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	meta.Size = n
+	if err := c.writeMeta(key, meta); err != nil {
+		return err
+	}
+	c.pendingAccess.Delete(key)
+	indexed = &IndexEntry{
+		Key:        key,
+		Path:       c.relBodyPath(key),
+		Size:       n,
+		StoredAt:   meta.StoredAt,
+		LastAccess: meta.StoredAt,
+	}
+	return nil
+}
+
+// UpdateMeta rewrites an existing entry's metadata in place, leaving its
+// stored body untouched. Used after a 304 revalidation, where the body is
+// known not to have changed.
+func (c *DiskCache) UpdateMeta(key string, meta *EntryMeta) error {
+	if meta == nil {
+		return errors.New("nil entry meta")
+	}
+	mu := c.lockFor(key)
+	mu.Lock()
+	if err := c.writeMeta(key, meta); err != nil {
+		mu.Unlock()
+		return err
+	}
+
+	size := int64(0)
+	if info, err := os.Stat(c.bodyPath(key)); err == nil {
+		size = info.Size()
+	}
+	c.pendingAccess.Delete(key)
+	mu.Unlock()
+	// Appended after releasing mu, for the same lock-order reason as Set.
+	_ = c.appendIndexEntry(IndexEntry{
+		Key:        key,
+		Path:       c.relBodyPath(key),
+		Size:       size,
+		StoredAt:   meta.StoredAt,
+		LastAccess: meta.StoredAt,
+	})
+	return nil
+}
+
+func (c *DiskCache) writeMeta(key string, meta *EntryMeta) error {
+	path := c.metaPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
-	// Write to temp file then rename for atomicity
 	tmp := path + ".tmp"
 	if err := os.WriteFile(tmp, b, 0o644); err != nil {
 		return err
@@ -87,21 +202,88 @@ func (c *DiskCache) Set(key string, e *Entry) error {
 
 // Delete removes the entry for key.
 func (c *DiskCache) Delete(key string) error {
-	path := c.filePathForKey(key)
+	firstErr := c.deleteFiles(key)
+
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	if entries, err := c.loadIndexLocked(); err == nil {
+		if _, ok := entries[key]; ok {
+			delete(entries, key)
+			_ = c.rewriteIndexLocked(entries)
+		}
+	}
+	return firstErr
+}
+
+// deleteFiles removes key's meta and body files and forgets any pending
+// access bump for it, without touching index.jsonl. Prune calls this
+// directly (while already holding indexMu) and rewrites the index itself
+// once it's done; Delete calls it too and scrubs the index separately.
+func (c *DiskCache) deleteFiles(key string) error {
 	mu := c.lockFor(key)
 	mu.Lock()
 	defer mu.Unlock()
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+
+	var firstErr error
+	for _, path := range []string{c.metaPath(key), c.bodyPath(key)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.pendingAccess.Delete(key)
+	return firstErr
+}
+
+// VariantIndex returns the known Vary information for urlKey, if any.
+func (c *DiskCache) VariantIndex(urlKey string) (*VariantIndex, bool, error) {
+	path := c.variantIndexPath(urlKey)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	var idx VariantIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, false, err
+	}
+	return &idx, true, nil
+}
+
+// SaveVariantIndex persists the Vary information for urlKey atomically.
+func (c *DiskCache) SaveVariantIndex(urlKey string, idx *VariantIndex) error {
+	path := c.variantIndexPath(urlKey)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	mu := c.lockFor(urlKey + ".vary")
+	mu.Lock()
+	defer mu.Unlock()
+
+	b, err := json.Marshal(idx)
+	if err != nil {
 		return err
 	}
-	return nil
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 // Clear deletes all cached entries under the cache directory.
-// It returns the number of files removed.
+// It returns the number of body files removed.
 func (c *DiskCache) Clear() (int, error) {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	c.pendingAccess.Range(func(k, _ any) bool {
+		c.pendingAccess.Delete(k)
+		return true
+	})
+
 	count := 0
-	// Remove only files we created (*.json) under sharded directories
 	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -109,14 +291,70 @@ func (c *DiskCache) Clear() (int, error) {
 		if info.IsDir() {
 			return nil
 		}
-		if filepath.Ext(path) == ".json" {
-			if removeErr := os.Remove(path); removeErr == nil {
+		ext := filepath.Ext(path)
+		if ext != ".json" && ext != ".body" && ext != ".jsonl" {
+			return nil
+		}
+		if removeErr := os.Remove(path); removeErr == nil {
+			if ext == ".body" {
 				count++
-			} else if !os.IsNotExist(removeErr) {
-				return removeErr
 			}
+		} else if !os.IsNotExist(removeErr) {
+			return removeErr
 		}
 		return nil
 	})
 	return count, err
 }
+
+// Iterate calls fn for every stored entry, deriving each key from its
+// on-disk meta filename, in unspecified order. It stops as soon as fn
+// returns false.
+func (c *DiskCache) Iterate(fn func(key string, meta EntryMeta) bool) error {
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".meta.json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var meta EntryMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.Base(path), ".meta.json")
+		if !fn(key, meta) {
+			return errStopIteration
+		}
+		return nil
+	})
+	if errors.Is(err, errStopIteration) {
+		return nil
+	}
+	return err
+}
+
+// Stats reports the number of entries on disk and their total body size.
+func (c *DiskCache) Stats() (Stats, error) {
+	var st Stats
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch {
+		case strings.HasSuffix(path, ".meta.json"):
+			st.Entries++
+		case strings.HasSuffix(path, ".body"):
+			st.Bytes += info.Size()
+		}
+		return nil
+	})
+	return st, err
+}
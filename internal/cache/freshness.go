@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl holds the directives relevant to a shared cache, parsed from
+// either a request's or a response's Cache-Control header.
+type CacheControl struct {
+	NoCache        bool
+	NoStore        bool
+	Private        bool
+	Public         bool
+	MustRevalidate bool
+	MaxAge         *int
+	SMaxAge        *int
+}
+
+// ParseCacheControl parses the Cache-Control header (request or response)
+// found in h. Unknown or malformed directives are ignored.
+func ParseCacheControl(h http.Header) CacheControl {
+	var cc CacheControl
+	for _, part := range strings.Split(h.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch name {
+		case "no-cache":
+			cc.NoCache = true
+		case "no-store":
+			cc.NoStore = true
+		case "private":
+			cc.Private = true
+		case "public":
+			cc.Public = true
+		case "must-revalidate", "proxy-revalidate":
+			cc.MustRevalidate = true
+		case "max-age":
+			if n, err := strconv.Atoi(value); err == nil {
+				cc.MaxAge = &n
+			}
+		case "s-maxage":
+			if n, err := strconv.Atoi(value); err == nil {
+				cc.SMaxAge = &n
+			}
+		}
+	}
+	return cc
+}
+
+// FreshnessLifetime computes how long the entry is considered fresh from the
+// moment it was stored, per RFC 7234 §4.2.1: s-maxage takes priority over
+// max-age, which takes priority over Expires. A cache-rules PolicyTTL
+// overrides all of them.
+func FreshnessLifetime(e *EntryMeta) time.Duration {
+	if e.PolicyTTL != nil {
+		return *e.PolicyTTL
+	}
+	cc := ParseCacheControl(e.Header)
+	if cc.SMaxAge != nil {
+		return time.Duration(*cc.SMaxAge) * time.Second
+	}
+	if cc.MaxAge != nil {
+		return time.Duration(*cc.MaxAge) * time.Second
+	}
+	if exp := e.Header.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			if lifetime := t.Sub(e.StoredAt); lifetime > 0 {
+				return lifetime
+			}
+		}
+		return 0
+	}
+	return 0
+}
+
+// CurrentAge computes the entry's current age per RFC 7234 §4.2.3: time
+// elapsed since it was stored, plus whatever Age the origin already reported.
+func CurrentAge(e *EntryMeta) time.Duration {
+	age := time.Since(e.StoredAt)
+	if v := e.Header.Get("Age"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			age += time.Duration(secs) * time.Second
+		}
+	}
+	return age
+}
+
+// IsFresh reports whether e can still be served without revalidation.
+func IsFresh(e *EntryMeta) bool {
+	return CurrentAge(e) < FreshnessLifetime(e)
+}
+
+// HasValidators reports whether e carries a validator usable for a
+// conditional revalidation request.
+func HasValidators(e *EntryMeta) bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
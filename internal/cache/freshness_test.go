@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsFresh(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name string
+		meta *EntryMeta
+		want bool
+	}{
+		{
+			name: "within max-age",
+			meta: &EntryMeta{
+				StoredAt: now.Add(-30 * time.Second),
+				Header:   http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			want: true,
+		},
+		{
+			name: "past max-age",
+			meta: &EntryMeta{
+				StoredAt: now.Add(-90 * time.Second),
+				Header:   http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			want: false,
+		},
+		{
+			name: "s-maxage overrides max-age",
+			meta: &EntryMeta{
+				StoredAt: now.Add(-90 * time.Second),
+				Header:   http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}},
+			},
+			want: true,
+		},
+		{
+			name: "policy TTL overrides headers",
+			meta: &EntryMeta{
+				StoredAt:  now.Add(-90 * time.Second),
+				Header:    http.Header{"Cache-Control": {"max-age=60"}},
+				PolicyTTL: durationPtr(120 * time.Second),
+			},
+			want: true,
+		},
+		{
+			name: "no freshness info",
+			meta: &EntryMeta{
+				StoredAt: now,
+				Header:   http.Header{},
+			},
+			want: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsFresh(tc.meta); got != tc.want {
+				t.Errorf("IsFresh() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHasValidators(t *testing.T) {
+	cases := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"etag", http.Header{"Etag": {`"abc"`}}, true},
+		{"last-modified", http.Header{"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"}}, true},
+		{"neither", http.Header{}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			meta := &EntryMeta{Header: tc.header}
+			if got := HasValidators(meta); got != tc.want {
+				t.Errorf("HasValidators() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration { return &d }
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// IndexEntry is one record in the cache's append-only index.jsonl, tracking
+// enough bookkeeping about a stored entry to prune it later without having
+// to stat every file on disk.
+type IndexEntry struct {
+	Key        string    `json:"key"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	StoredAt   time.Time `json:"storedAt"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+// PruneOptions bounds what Prune keeps. A zero MaxBytes or MaxAge means that
+// budget isn't enforced.
+type PruneOptions struct {
+	MaxBytes   int64
+	MaxAge     time.Duration
+	KeepLatest int
+}
+
+func (c *DiskCache) indexPath() string {
+	return filepath.Join(c.dir, "index.jsonl")
+}
+
+// appendIndexEntry records e in the append-only index. Compaction (done by
+// Prune) later collapses repeated records for the same key down to the
+// latest one.
+func (c *DiskCache) appendIndexEntry(e IndexEntry) error {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	return c.appendIndexEntryLocked(e)
+}
+
+func (c *DiskCache) appendIndexEntryLocked(e IndexEntry) error {
+	f, err := os.OpenFile(c.indexPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// loadIndexLocked reads index.jsonl into a map keyed by cache key, with
+// later records for the same key overriding earlier ones.
+func (c *DiskCache) loadIndexLocked() (map[string]IndexEntry, error) {
+	entries := map[string]IndexEntry{}
+	f, err := os.Open(c.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e IndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // skip a corrupt line rather than fail the whole index
+		}
+		entries[e.Key] = e
+	}
+	return entries, scanner.Err()
+}
+
+// rewriteIndexLocked replaces index.jsonl with exactly the given entries.
+func (c *DiskCache) rewriteIndexLocked(entries map[string]IndexEntry) error {
+	tmp := c.indexPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.indexPath())
+}
+
+// recordAccess notes that key was read just now. The update isn't written to
+// disk until the next Prune compacts the index, so hot-path reads stay cheap.
+func (c *DiskCache) recordAccess(key string) {
+	c.pendingAccess.Store(key, time.Now())
+}
+
+// Prune evicts entries until the cache is within opts's budgets, preferring
+// to evict the least-recently-used entries first, and compacts index.jsonl
+// to reflect what remains. KeepLatest, if set, always protects that many of
+// the most-recently-used entries regardless of MaxBytes/MaxAge.
+func (c *DiskCache) Prune(ctx context.Context, opts PruneOptions) (removed int, freed int64, err error) {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+
+	entries, err := c.loadIndexLocked()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c.pendingAccess.Range(func(k, v any) bool {
+		key := k.(string)
+		if e, ok := entries[key]; ok {
+			e.LastAccess = v.(time.Time)
+			entries[key] = e
+		}
+		c.pendingAccess.Delete(k)
+		return true
+	})
+
+	list := make([]IndexEntry, 0, len(entries))
+	var total int64
+	for _, e := range entries {
+		list = append(list, e)
+		total += e.Size
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastAccess.Before(list[j].LastAccess) })
+
+	now := time.Now()
+	kept := make(map[string]IndexEntry, len(list))
+	for i, e := range list {
+		if ctx.Err() != nil {
+			// Keep whatever's left as-is; report what we already removed.
+			kept[e.Key] = e
+			continue
+		}
+		protected := opts.KeepLatest > 0 && i >= len(list)-opts.KeepLatest
+		expired := opts.MaxAge > 0 && now.Sub(e.StoredAt) > opts.MaxAge
+		overBudget := opts.MaxBytes > 0 && total > opts.MaxBytes
+		if !protected && (expired || overBudget) {
+			if delErr := c.deleteFiles(e.Key); delErr == nil {
+				removed++
+				freed += e.Size
+				total -= e.Size
+				continue
+			}
+		}
+		kept[e.Key] = e
+	}
+
+	if err := c.rewriteIndexLocked(kept); err != nil {
+		return removed, freed, err
+	}
+	return removed, freed, ctx.Err()
+}
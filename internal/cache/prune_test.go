@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPruneEvictsLeastRecentlyUsedFirst(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(key string, size int, age time.Duration) {
+		meta := &EntryMeta{
+			Status:   http.StatusOK,
+			Header:   http.Header{},
+			StoredAt: time.Now().Add(-age),
+		}
+		if err := dc.Set(key, meta, bytes.NewReader(make([]byte, size))); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+	}
+
+	store("oldest", 10, 3*time.Hour)
+	store("middle", 10, 2*time.Hour)
+	store("newest", 10, time.Hour)
+
+	// Prune's LastAccess ordering comes from the index, so back-date the
+	// entries' recorded access times directly rather than relying on Get's
+	// lazy bump, which would all collapse to "now".
+	entries, err := dc.loadIndexLocked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bump := func(key string, age time.Duration) {
+		e := entries[key]
+		e.LastAccess = time.Now().Add(-age)
+		entries[key] = e
+	}
+	bump("oldest", 3*time.Hour)
+	bump("middle", 2*time.Hour)
+	bump("newest", time.Hour)
+	if err := dc.rewriteIndexLocked(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, _, err := dc.Prune(context.Background(), PruneOptions{MaxBytes: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed = %d, want 1", removed)
+	}
+
+	if _, _, ok, _ := dc.Get("oldest"); ok {
+		t.Error("oldest entry should have been evicted")
+	}
+	if _, body, ok, _ := dc.Get("middle"); !ok {
+		t.Error("middle entry should have survived")
+	} else {
+		body.Close()
+	}
+	if _, body, ok, _ := dc.Get("newest"); !ok {
+		t.Error("newest entry should have survived")
+	} else {
+		body.Close()
+	}
+}
+
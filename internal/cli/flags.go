@@ -7,15 +7,51 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"time"
+
+	"caching-proxy/internal/rules"
 )
 
 type Options struct {
-	Port        int
-	Origin      string
-	CacheDir    string
-	ShowVersion bool
-	ClearCache  bool
-	LogLevel    string
+	Port             int
+	Origin           string
+	CacheDir         string
+	ShowVersion      bool
+	ClearCache       bool
+	LogLevel         string
+	CoalesceTimeout  time.Duration
+	MaxCoalesceBody  ByteSize
+	MaxCacheableBody ByteSize
+	StreamThreshold  ByteSize
+
+	// GCInterval is how often the running server prunes the cache in the
+	// background. GCMaxBytes/GCMaxAge/GCKeepLatest are the budgets it prunes
+	// to; zero means that budget isn't enforced.
+	GCInterval   time.Duration
+	GCMaxBytes   ByteSize
+	GCMaxAge     time.Duration
+	GCKeepLatest int
+
+	// Command, when non-empty, selects a one-shot mode other than running the
+	// server (currently just "prune"), parsed from the first positional
+	// argument. PruneMaxBytes/PruneMaxAge/PruneKeepLatest hold its flags.
+	Command         string
+	PruneMaxBytes   ByteSize
+	PruneMaxAge     time.Duration
+	PruneKeepLatest int
+
+	// AdminAddr, if set, runs a separate admin HTTP listener exposing cache
+	// introspection and purge endpoints under /_cache/. AdminToken, if set,
+	// is the bearer token required to call them.
+	AdminAddr  string
+	AdminToken string
+
+	// CacheRulesPath, if set, names a JSON file of URL-pattern cache policy
+	// rules; it is loaded into Rules during Parse. CacheRulesDryRun logs
+	// which rule matched each request instead of enforcing it.
+	CacheRulesPath   string
+	CacheRulesDryRun bool
+	Rules            *rules.Rules
 }
 
 func DefaultCacheDir() string {
@@ -31,6 +67,10 @@ func DefaultCacheDir() string {
 }
 
 func Parse(args []string) (Options, error) {
+	if len(args) > 0 && args[0] == "prune" {
+		return parsePrune(args[1:])
+	}
+
 	fs := flag.NewFlagSet("caching-proxy", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
 
@@ -41,11 +81,34 @@ func Parse(args []string) (Options, error) {
 	fs.BoolVar(&opts.ShowVersion, "version", false, "Print version and exit")
 	fs.BoolVar(&opts.ClearCache, "clear-cache", false, "Clear cache directory and exit")
 	fs.StringVar(&opts.LogLevel, "log-level", "info", "Log level: info|debug")
+	fs.DurationVar(&opts.CoalesceTimeout, "coalesce-timeout", 10*time.Second, "How long a request waits for an in-flight fetch of the same URL before fetching on its own")
+	opts.MaxCoalesceBody = 8 << 20
+	fs.Var(&opts.MaxCoalesceBody, "max-coalesce-body", "Largest response body (by Content-Length, or actual size if unknown) that concurrent requests may share via coalescing (e.g. 8MB); larger responses fall through to fetching on their own")
+	opts.MaxCacheableBody = 64 << 20
+	fs.Var(&opts.MaxCacheableBody, "max-cacheable-body", "Largest response body to store in the cache (e.g. 64MB); larger responses are still proxied but not cached")
+	opts.StreamThreshold = 1 << 20
+	fs.Var(&opts.StreamThreshold, "stream-threshold", "Response body size above which the cache write is streamed instead of buffered in memory")
+	fs.DurationVar(&opts.GCInterval, "gc-interval", time.Hour, "How often to prune the cache in the background; 0 disables background pruning")
+	fs.Var(&opts.GCMaxBytes, "gc-max-size", "Total cache size to prune down to in the background (e.g. 500MB); 0 means unbounded")
+	fs.DurationVar(&opts.GCMaxAge, "gc-max-age", 0, "Maximum age of a cache entry to keep during background pruning (e.g. 168h); 0 means unbounded")
+	fs.IntVar(&opts.GCKeepLatest, "gc-keep-latest", 0, "Always keep at least this many most-recently-used entries during background pruning")
+	fs.StringVar(&opts.AdminAddr, "admin-addr", "", "Address for the admin API (e.g. :9090); empty disables it")
+	fs.StringVar(&opts.AdminToken, "admin-token", "", "Bearer token required on admin API requests; empty allows unauthenticated access")
+	fs.StringVar(&opts.CacheRulesPath, "cache-rules", "", "Path to a JSON file of URL-pattern cache policy rules")
+	fs.BoolVar(&opts.CacheRulesDryRun, "cache-rules-dry-run", false, "Log which cache rule matched each request instead of enforcing it")
 
 	if err := fs.Parse(args); err != nil {
 		return Options{}, err
 	}
 
+	if opts.CacheRulesPath != "" {
+		loaded, err := rules.Load(opts.CacheRulesPath, opts.CacheRulesDryRun)
+		if err != nil {
+			return Options{}, fmt.Errorf("loading --cache-rules: %w", err)
+		}
+		opts.Rules = loaded
+	}
+
 	// If just printing version or clearing cache, skip full validation below.
 	if opts.ShowVersion {
 		return opts, nil
@@ -61,6 +124,25 @@ func Parse(args []string) (Options, error) {
 	return opts, nil
 }
 
+// parsePrune handles `caching-proxy prune ...`, a one-shot mode that evicts
+// cache entries down to the given budgets and exits, independent of the
+// background GC a running server performs.
+func parsePrune(args []string) (Options, error) {
+	fs := flag.NewFlagSet("caching-proxy prune", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+
+	opts := Options{Command: "prune"}
+	fs.StringVar(&opts.CacheDir, "cache-dir", DefaultCacheDir(), "Directory for on-disk cache")
+	fs.Var(&opts.PruneMaxBytes, "max-size", "Total cache size to prune down to (e.g. 500MB); 0 means unbounded")
+	fs.DurationVar(&opts.PruneMaxAge, "max-age", 0, "Maximum age of a cache entry to keep (e.g. 168h); 0 means unbounded")
+	fs.IntVar(&opts.PruneKeepLatest, "keep-latest", 0, "Always keep at least this many most-recently-used entries")
+
+	if err := fs.Parse(args); err != nil {
+		return Options{}, err
+	}
+	return opts, nil
+}
+
 func Validate(opts Options) error {
 	if opts.Port <= 0 || opts.Port > 65535 {
 		return fmt.Errorf("invalid --port: %d", opts.Port)
@@ -77,5 +159,17 @@ func Validate(opts Options) error {
 	default:
 		return fmt.Errorf("invalid --log-level: %s (expected info|debug)", opts.LogLevel)
 	}
+	if opts.CoalesceTimeout <= 0 {
+		return fmt.Errorf("invalid --coalesce-timeout: %s", opts.CoalesceTimeout)
+	}
+	if opts.MaxCoalesceBody <= 0 {
+		return fmt.Errorf("invalid --max-coalesce-body: %s", opts.MaxCoalesceBody)
+	}
+	if opts.MaxCacheableBody <= 0 {
+		return fmt.Errorf("invalid --max-cacheable-body: %s", opts.MaxCacheableBody)
+	}
+	if opts.StreamThreshold <= 0 {
+		return fmt.Errorf("invalid --stream-threshold: %s", opts.StreamThreshold)
+	}
 	return nil
 }
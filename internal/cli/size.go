@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a flag.Value for byte-count flags that accept a bare number of
+// bytes or a number suffixed with KB/MB/GB (binary multiples, e.g. "64MB" ==
+// 64*1024*1024 bytes).
+type ByteSize int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"GiB", 1 << 30},
+	{"GB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"MB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (s ByteSize) String() string {
+	return strconv.FormatInt(int64(s), 10)
+}
+
+// Set parses v, which may be a bare byte count ("65536") or a number
+// suffixed with a binary unit ("64MB", "500MiB").
+func (s *ByteSize) Set(v string) error {
+	v = strings.TrimSpace(v)
+	for _, suf := range sizeSuffixes {
+		if strings.HasSuffix(v, suf.suffix) {
+			numPart := strings.TrimSpace(strings.TrimSuffix(v, suf.suffix))
+			n, err := strconv.ParseFloat(numPart, 64)
+			if err != nil {
+				return fmt.Errorf("invalid size %q: %w", v, err)
+			}
+			*s = ByteSize(n * float64(suf.mult))
+			return nil
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %w", v, err)
+	}
+	*s = ByteSize(n)
+	return nil
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"caching-proxy/internal/cache"
+)
+
+// adminCounters tracks cache effectiveness totals, incremented by the
+// handler as it serves requests and reported by the admin /_cache/stats
+// endpoint.
+type adminCounters struct {
+	hits   int64
+	misses int64
+}
+
+func (c *adminCounters) recordHit()  { atomic.AddInt64(&c.hits, 1) }
+func (c *adminCounters) recordMiss() { atomic.AddInt64(&c.misses, 1) }
+
+// adminServer implements the /_cache/ introspection and purge endpoints.
+type adminServer struct {
+	cache    cache.Cache
+	counters *adminCounters
+	token    string
+}
+
+// newAdminMux builds the admin HTTP handler for s.
+func newAdminMux(s *adminServer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_cache/stats", s.withAuth(s.handleStats))
+	mux.HandleFunc("/_cache/entries", s.withAuth(s.handleEntries))
+	mux.HandleFunc("/_cache/entries/", s.withAuth(s.handleDeleteEntry))
+	mux.HandleFunc("/_cache/purge", s.withAuth(s.handlePurge))
+	return mux
+}
+
+// withAuth rejects requests lacking the configured bearer token. When no
+// token is configured, every request is allowed through.
+func (s *adminServer) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *adminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := s.cache.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries": st.Entries,
+		"bytes":   st.Bytes,
+		"hits":    atomic.LoadInt64(&s.counters.hits),
+		"misses":  atomic.LoadInt64(&s.counters.misses),
+	})
+}
+
+// entrySummary is the shape returned by GET /_cache/entries.
+type entrySummary struct {
+	Key        string    `json:"key"`
+	URL        string    `json:"url"`
+	Status     int       `json:"status"`
+	Size       int64     `json:"size"`
+	StoredAt   time.Time `json:"storedAt"`
+	TTLSeconds float64   `json:"ttlSeconds"`
+}
+
+// handleEntries lists entries whose key starts with the prefix query param,
+// paginated by limit (default 100, max 1000) and an opaque cursor (the last
+// key returned by the previous page).
+func (s *adminServer) handleEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	cursor := r.URL.Query().Get("cursor")
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+
+	var out []entrySummary
+	var next string
+	err := s.cache.Iterate(func(key string, meta cache.EntryMeta) bool {
+		if prefix != "" && !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		if cursor != "" && key <= cursor {
+			return true
+		}
+		out = append(out, entrySummary{
+			Key:        key,
+			URL:        meta.URL,
+			Status:     meta.Status,
+			Size:       meta.Size,
+			StoredAt:   meta.StoredAt,
+			TTLSeconds: (cache.FreshnessLifetime(&meta) - cache.CurrentAge(&meta)).Seconds(),
+		})
+		if len(out) >= limit {
+			next = key
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+
+	writeJSON(w, http.StatusOK, map[string]any{"entries": out, "next": next})
+}
+
+// handleDeleteEntry handles DELETE /_cache/entries/{sha256}.
+func (s *adminServer) handleDeleteEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/_cache/entries/")
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.cache.Delete(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeRequest is the JSON body accepted by POST /_cache/purge.
+type purgeRequest struct {
+	URLs  []string `json:"urls"`
+	Regex string   `json:"regex"`
+}
+
+// handlePurge invalidates every entry whose URL exactly matches one of
+// req.URLs or matches req.Regex.
+func (s *adminServer) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var re *regexp.Regexp
+	if req.Regex != "" {
+		var err error
+		re, err = regexp.Compile(req.Regex)
+		if err != nil {
+			http.Error(w, "invalid regex: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	urlSet := make(map[string]bool, len(req.URLs))
+	for _, u := range req.URLs {
+		urlSet[u] = true
+	}
+
+	var keys []string
+	err := s.cache.Iterate(func(key string, meta cache.EntryMeta) bool {
+		if urlSet[meta.URL] || (re != nil && re.MatchString(meta.URL)) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	purged := 0
+	for _, key := range keys {
+		if err := s.cache.Delete(key); err == nil {
+			purged++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"purged": purged})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
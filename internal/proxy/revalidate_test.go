@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"caching-proxy/internal/cache"
+	"caching-proxy/internal/rules"
+)
+
+// TestRevalidate_StoresRefreshedEntryUnderPolicyAwareKey reproduces an
+// orphaned-entry bug: with a cache-rules ignore_query policy active, a 200
+// refresh from revalidate must be stored under the same policy-aware base
+// key serveCacheable looked the entry up under, or the refreshed
+// representation is unreachable and the stale entry gets re-revalidated
+// forever.
+func TestRevalidate_StoresRefreshedEntryUnderPolicyAwareKey(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, n))
+		if n == 1 {
+			// Immediately stale, so the next request revalidates.
+			w.Header().Set("Cache-Control", "max-age=0")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(fmt.Sprintf("v%d", n)))
+	}))
+	defer origin.Close()
+
+	target, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := cache.NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(rulesPath, []byte(`[{"match": ".*", "policy": "cache", "ignore_query": ["_"]}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loadedRules, err := rules.Load(rulesPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handler{
+		originBase:       origin.URL,
+		target:           target,
+		cache:            dc,
+		baseProxy:        newReverseProxy(target),
+		client:           &http.Client{Timeout: 5 * time.Second},
+		coalesceTimeout:  5 * time.Second,
+		maxCoalesceBody:  8 << 20,
+		maxCacheableBody: 64 << 20,
+		streamThreshold:  1 << 20,
+		counters:         &adminCounters{},
+		rules:            loadedRules,
+	}
+
+	get := func(cacheBuster string) string {
+		req := httptest.NewRequest(http.MethodGet, "/data?_="+cacheBuster, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.serveHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	if got := get("1"); got != "v1" {
+		t.Fatalf("first request body = %q, want %q", got, "v1")
+	}
+	if got := get("2"); got != "v2" {
+		t.Fatalf("second request (revalidate refresh) body = %q, want %q", got, "v2")
+	}
+	if got := get("3"); got != "v2" {
+		t.Fatalf("third request body = %q, want %q (served from the refreshed entry)", got, "v2")
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("origin hit %d times, want 2 (initial population + one refresh)", got)
+	}
+}
@@ -11,20 +11,115 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"caching-proxy/internal/cache"
+	"caching-proxy/internal/rules"
 )
 
-// Run starts an HTTP server on the given port and proxies to the provided origin base URL.
-// It blocks until the context is cancelled, at which point it gracefully shuts down.
-func Run(ctx context.Context, port int, originBase string, c cache.Cache, debug bool) error {
-	target, err := url.Parse(originBase)
+// Config holds the settings Run needs to start the proxy. It is assembled by
+// cmd/caching-proxy from the parsed CLI options.
+type Config struct {
+	Port             int
+	OriginBase       string
+	Cache            cache.Cache
+	Debug            bool
+	CoalesceTimeout  time.Duration
+	MaxCoalesceBody  int64
+	MaxCacheableBody int64
+	StreamThreshold  int64
+
+	// GCInterval is how often the cache is pruned in the background; 0
+	// disables background pruning. GCMaxBytes/GCMaxAge/GCKeepLatest are the
+	// budgets each prune enforces.
+	GCInterval   time.Duration
+	GCMaxBytes   int64
+	GCMaxAge     time.Duration
+	GCKeepLatest int
+
+	// AdminAddr, if non-empty, is the address a separate admin HTTP listener
+	// exposes cache introspection and purge endpoints on. AdminToken, if
+	// non-empty, is the bearer token required to call them.
+	AdminAddr  string
+	AdminToken string
+
+	// Rules, if non-nil, is matched against each request's path to decide
+	// whether to bypass the cache, override its TTL, canonicalize its query
+	// string, or strip headers before forwarding.
+	Rules *rules.Rules
+}
+
+// Run starts an HTTP server according to cfg and proxies to the configured
+// origin. It blocks until the context is cancelled, at which point it
+// gracefully shuts down.
+func Run(ctx context.Context, cfg Config) error {
+	target, err := url.Parse(cfg.OriginBase)
 	if err != nil {
 		return fmt.Errorf("invalid origin: %w", err)
 	}
 
-	baseProxy := newReverseProxy(target)
+	coalesceTimeout := cfg.CoalesceTimeout
+	if coalesceTimeout <= 0 {
+		coalesceTimeout = 10 * time.Second
+	}
+	maxCoalesceBody := cfg.MaxCoalesceBody
+	if maxCoalesceBody <= 0 {
+		maxCoalesceBody = 8 << 20
+	}
+	maxCacheableBody := cfg.MaxCacheableBody
+	if maxCacheableBody <= 0 {
+		maxCacheableBody = 64 << 20
+	}
+	streamThreshold := cfg.StreamThreshold
+	if streamThreshold <= 0 {
+		streamThreshold = 1 << 20
+	}
+
+	counters := &adminCounters{}
+
+	h := &handler{
+		originBase:       cfg.OriginBase,
+		target:           target,
+		cache:            cfg.Cache,
+		debug:            cfg.Debug,
+		baseProxy:        newReverseProxy(target),
+		client:           &http.Client{Timeout: 30 * time.Second},
+		coalesceTimeout:  coalesceTimeout,
+		maxCoalesceBody:  maxCoalesceBody,
+		maxCacheableBody: maxCacheableBody,
+		streamThreshold:  streamThreshold,
+		counters:         counters,
+		rules:            cfg.Rules,
+	}
+
+	if cfg.GCInterval > 0 && cfg.Cache != nil {
+		go runGC(ctx, cfg.Cache, cfg.GCInterval, cache.PruneOptions{
+			MaxBytes:   cfg.GCMaxBytes,
+			MaxAge:     cfg.GCMaxAge,
+			KeepLatest: cfg.GCKeepLatest,
+		})
+	}
+
+	if cfg.AdminAddr != "" && cfg.Cache != nil {
+		adminSrv := &http.Server{
+			Addr:              cfg.AdminAddr,
+			Handler:           newAdminMux(&adminServer{cache: cfg.Cache, counters: counters, token: cfg.AdminToken}),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("admin listening on %s", adminSrv.Addr)
+			if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("admin server error: %v", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = adminSrv.Shutdown(shutdownCtx)
+		}()
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -32,77 +127,10 @@ func Run(ctx context.Context, port int, originBase string, c cache.Cache, debug
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		lw := &loggingWriter{ResponseWriter: w, status: http.StatusOK}
-
-		cacheEligible := r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && !reqNoStore(r)
-
-		if c != nil && cacheEligible {
-			key, err := cache.BuildCacheKey(originBase, r)
-			if err == nil {
-				if ent, ok, _ := c.Get(key); ok && ent != nil {
-					// cache HIT
-					copyHeaders(lw.Header(), ent.Header)
-					lw.Header().Set("X-Cache", "HIT")
-					filterHopByHop(lw.Header())
-					lw.WriteHeader(ent.Status)
-					_, _ = lw.Write(ent.Body)
-					dur := time.Since(start)
-					if debug {
-						log.Printf("%s %s -> %d %dB %s (HIT)", r.Method, requestLine(r), lw.status, lw.bytes, dur)
-					} else {
-						log.Printf("%s %s -> %d %s", r.Method, requestLine(r), lw.status, dur)
-					}
-					return
-				}
-
-				// cache MISS: use a per-request proxy to capture and store
-				rp := newReverseProxy(target)
-				rp.ModifyResponse = func(res *http.Response) error {
-					filterHopByHop(res.Header)
-					res.Header.Set("X-Cache", "MISS")
-					if resNoStore(res) {
-						return nil
-					}
-					// buffer body
-					b, err := io.ReadAll(res.Body)
-					if err != nil {
-						return err
-					}
-					_ = res.Body.Close()
-					res.Body = io.NopCloser(bytes.NewReader(b))
-					res.ContentLength = int64(len(b))
-					res.Header.Set("Content-Length", fmt.Sprintf("%d", len(b)))
-					// store
-					entry := &cache.Entry{Status: res.StatusCode, Header: cache.CloneHeaders(res.Header), Body: b}
-					_ = c.Set(key, entry)
-					return nil
-				}
-				// Serve via this rp
-				rp.ServeHTTP(lw, r)
-				dur := time.Since(start)
-				if debug {
-					log.Printf("%s %s -> %d %dB %s (MISS)", r.Method, requestLine(r), lw.status, lw.bytes, dur)
-				} else {
-					log.Printf("%s %s -> %d %s", r.Method, requestLine(r), lw.status, dur)
-				}
-				return
-			}
-		}
-
-		// Not cache-eligible or cache disabled: use base proxy
-		baseProxy.ServeHTTP(lw, r)
-		dur := time.Since(start)
-		if debug {
-			log.Printf("%s %s -> %d %dB %s", r.Method, requestLine(r), lw.status, lw.bytes, dur)
-		} else {
-			log.Printf("%s %s -> %d %s", r.Method, requestLine(r), lw.status, dur)
-		}
-	})
+	mux.HandleFunc("/", h.serveHTTP)
 
 	srv := &http.Server{
-		Addr:              fmt.Sprintf(":%d", port),
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
 		Handler:           mux,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
@@ -129,6 +157,572 @@ func Run(ctx context.Context, port int, originBase string, c cache.Cache, debug
 	}
 }
 
+// runGC periodically prunes c to opts's budgets until ctx is cancelled,
+// logging what each pass removed.
+func runGC(ctx context.Context, c cache.Cache, interval time.Duration, opts cache.PruneOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, freed, err := c.Prune(ctx, opts)
+			if err != nil {
+				log.Printf("cache gc error: %v", err)
+				continue
+			}
+			log.Printf("cache gc: removed=%d freed_bytes=%d", removed, freed)
+		}
+	}
+}
+
+// handler serves proxied requests, consulting and populating the cache
+// according to RFC 7234 freshness/revalidation/Vary rules.
+type handler struct {
+	originBase string
+	target     *url.URL
+	cache      cache.Cache
+	debug      bool
+	baseProxy  *httputil.ReverseProxy
+	client     *http.Client
+
+	// coalesceTimeout bounds how long a concurrent request waits for another
+	// in-flight fetch of the same key before giving up and fetching on its own.
+	coalesceTimeout time.Duration
+	// maxCoalesceBody bounds how large a response origin may declare (via
+	// Content-Length) before coalescing is skipped for it; a slow client
+	// reading a huge body shouldn't stall every other request for the same
+	// URL.
+	maxCoalesceBody int64
+	// inflight tracks cache keys currently being fetched from origin, so
+	// concurrent misses for the same key share a single origin request.
+	inflight sync.Map // map[string]*inflightCall
+
+	// maxCacheableBody is the largest body that will be written to the cache;
+	// larger responses are still proxied to the client but not stored.
+	maxCacheableBody int64
+	// streamThreshold is the body size above which a response is tee'd
+	// straight to the client and cache in parallel, instead of buffered.
+	streamThreshold int64
+
+	// counters tracks cache hit/miss totals for the admin /_cache/stats
+	// endpoint.
+	counters *adminCounters
+
+	// rules holds the loaded --cache-rules policy, or nil if none was
+	// configured.
+	rules *rules.Rules
+}
+
+// errBodyTooLargeToCache marks a streamed cache write aborted because the
+// body exceeded maxCacheableBody; the client is unaffected.
+var errBodyTooLargeToCache = errors.New("response body exceeds max-cacheable-body")
+
+// inflightCall represents a single origin fetch shared by all concurrent
+// requests for the same cache key.
+type inflightCall struct {
+	done   chan struct{}
+	result *inflightResult
+}
+
+// inflightResult is the outcome of the leader's origin fetch, shared with
+// any requests that coalesced onto it.
+type inflightResult struct {
+	status int
+	header http.Header
+	body   []byte
+	err    error
+
+	// reqHeader is the leader's own request headers, kept so a follower can
+	// check a Vary-ing result actually matches its own request before
+	// accepting it; see fetchCoalesced.
+	reqHeader http.Header
+}
+
+func (h *handler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lw := &loggingWriter{ResponseWriter: w, status: http.StatusOK}
+
+	decision := h.resolveDecision(r)
+	for _, name := range decision.StripHeaders {
+		r.Header.Del(name)
+	}
+
+	reqCC := cache.ParseCacheControl(r.Header)
+	cacheEligible := r.Method == http.MethodGet && r.Header.Get("Authorization") == "" &&
+		!reqCC.NoStore && decision.Policy != rules.PolicyBypass
+
+	if h.cache != nil && cacheEligible {
+		if h.serveCacheable(lw, r, reqCC, decision) {
+			h.logRequest(r, lw, start)
+			return
+		}
+	}
+
+	// Not cache-eligible, cache disabled, or the cacheable path fell through
+	// (e.g. key computation failed): use the base proxy untouched.
+	h.baseProxy.ServeHTTP(lw, r)
+	h.logRequest(r, lw, start)
+}
+
+// resolveDecision matches r against h.rules. In --cache-rules-dry-run mode it
+// logs a matched rule without applying it, so operators can validate a
+// config before enabling it.
+func (h *handler) resolveDecision(r *http.Request) rules.Decision {
+	if h.rules == nil {
+		return rules.Decision{Policy: rules.PolicyCache}
+	}
+	d := h.rules.Match(r.URL.Path)
+	if h.rules.DryRun() {
+		if d.MatchedRule != "" {
+			log.Printf("cache-rules dry-run: %s matched rule %q -> policy=%s", requestLine(r), d.MatchedRule, d.Policy)
+		}
+		return rules.Decision{Policy: rules.PolicyCache}
+	}
+	return d
+}
+
+// serveCacheable attempts to serve r from cache (possibly after
+// revalidating), falling back to an uncached origin fetch on miss. It
+// returns true once it has written a response to lw.
+func (h *handler) serveCacheable(lw *loggingWriter, r *http.Request, reqCC cache.CacheControl, decision rules.Decision) bool {
+	urlKey, err := cache.HashURLWithPolicy(h.originBase, r, queryPolicy(decision))
+	if err != nil {
+		return false
+	}
+
+	key := urlKey
+	if idx, ok, _ := h.cache.VariantIndex(urlKey); ok {
+		key = cache.VaryKey(urlKey, idx.Vary, r.Header)
+	}
+
+	ent, body, ok, _ := h.cache.Get(key)
+	if !ok || ent == nil {
+		h.fetchCoalesced(lw, r, urlKey, key, "MISS", decision)
+		return true
+	}
+
+	entCC := cache.ParseCacheControl(ent.Header)
+	if !reqCC.NoCache && !entCC.NoCache && cache.IsFresh(ent) {
+		h.counters.recordHit()
+		h.writeFromEntry(lw, ent, body, "HIT")
+		return true
+	}
+
+	if cache.HasValidators(ent) {
+		h.revalidate(lw, r, urlKey, key, ent, body, decision)
+		return true
+	}
+
+	// Stale with nothing to revalidate against: treat as a miss.
+	_ = body.Close()
+	h.fetchCoalesced(lw, r, urlKey, key, "MISS", decision)
+	return true
+}
+
+// queryPolicy converts a rules.Decision's query directives into the
+// cache.QueryPolicy HashURLWithPolicy expects.
+func queryPolicy(decision rules.Decision) cache.QueryPolicy {
+	return cache.QueryPolicy{VaryQuery: decision.VaryQuery, IgnoreQuery: decision.IgnoreQuery}
+}
+
+// fetchCoalesced serves a cache miss, coalescing concurrent requests for the
+// same key onto a single origin fetch. The first caller to claim the key
+// becomes the leader and performs the fetch; others wait for it to finish and
+// share its result. A caller that waits past coalesceTimeout, or whose leader
+// produced a response too large to share, falls back to fetching on its own.
+func (h *handler) fetchCoalesced(lw *loggingWriter, r *http.Request, urlKey, key, cacheStatus string, decision rules.Decision) {
+	h.counters.recordMiss()
+	call := &inflightCall{done: make(chan struct{})}
+	actual, loaded := h.inflight.LoadOrStore(key, call)
+	call = actual.(*inflightCall)
+
+	if !loaded {
+		defer h.inflight.Delete(key)
+		h.fetchLeader(lw, r, urlKey, key, cacheStatus, decision, call)
+		return
+	}
+
+	select {
+	case <-call.done:
+		if res := call.result; res != nil && res.err == nil && varyMatches(res, r.Header) {
+			h.writeShared(lw, res, cacheStatus)
+			return
+		}
+	case <-time.After(h.coalesceTimeout):
+	}
+	h.fetchAndStore(lw, r, urlKey, key, cacheStatus, decision)
+}
+
+// varyMatches reports whether a coalesced leader's result can be shared with
+// a follower whose request headers are reqHeader. If the response didn't
+// declare Vary, every request for the key gets the same representation and
+// it always matches; otherwise the follower's Vary-relevant headers must
+// fingerprint the same as the leader's, or it would be served the wrong
+// representation (e.g. the wrong language or encoding).
+func varyMatches(res *inflightResult, reqHeader http.Header) bool {
+	vary := cache.VaryHeaders(res.header.Get("Vary"))
+	if len(vary) == 0 {
+		return true
+	}
+	if cache.VaryAll(vary) {
+		return false
+	}
+	return cache.FingerprintVary(vary, res.reqHeader) == cache.FingerprintVary(vary, reqHeader)
+}
+
+// fetchLeader performs the shared origin fetch for fetchCoalesced. It uses a
+// context independent of r so that one waiting client disconnecting doesn't
+// abort the fetch for the others coalesced onto it.
+func (h *handler) fetchLeader(lw *loggingWriter, r *http.Request, urlKey, key, cacheStatus string, decision rules.Decision, call *inflightCall) {
+	req, err := http.NewRequestWithContext(context.Background(), r.Method, targetURL(h.target, r), nil)
+	if err != nil {
+		close(call.done)
+		h.baseProxy.ServeHTTP(lw, r)
+		return
+	}
+	req.Header = r.Header.Clone()
+	filterHopByHop(req.Header)
+	req.Host = h.target.Host
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		call.result = &inflightResult{err: err}
+		close(call.done)
+		log.Printf("proxy error: %v", err)
+		http.Error(lw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	filterHopByHop(res.Header)
+
+	if res.ContentLength > h.maxCoalesceBody {
+		// Too large to hold in memory for followers; let them fetch on their own.
+		close(call.done)
+		h.storeAndWriteWithURLKey(lw, r, res, urlKey, key, cacheStatus, decision)
+		return
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, h.maxCoalesceBody+1))
+	if err != nil {
+		call.result = &inflightResult{err: err}
+		close(call.done)
+		http.Error(lw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if int64(len(b)) > h.maxCoalesceBody {
+		// No (or wrong) Content-Length hinted at this; don't share a
+		// followers' copy, but still serve and store it ourselves.
+		close(call.done)
+		res.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), res.Body))
+		h.storeAndWriteWithURLKey(lw, r, res, urlKey, key, cacheStatus, decision)
+		return
+	}
+
+	call.result = &inflightResult{
+		status:    res.StatusCode,
+		header:    cache.CloneHeaders(res.Header),
+		body:      b,
+		reqHeader: cache.CloneHeaders(r.Header),
+	}
+	close(call.done)
+
+	res.Body = io.NopCloser(bytes.NewReader(b))
+	h.storeAndWriteWithURLKey(lw, r, res, urlKey, key, cacheStatus, decision)
+}
+
+// writeShared serves a result produced by another request's fetchLeader call.
+func (h *handler) writeShared(lw *loggingWriter, res *inflightResult, cacheStatus string) {
+	copyHeaders(lw.Header(), res.header)
+	lw.Header().Set("X-Cache", cacheStatus)
+	lw.WriteHeader(res.status)
+	_, _ = lw.Write(res.body)
+}
+
+// revalidate issues a conditional request to origin using ent's validators
+// and serves either the still-valid cached entry (304) or a fresh one (200).
+// It takes ownership of body and closes it along every path. urlKey is the
+// policy-aware base key serveCacheable computed, threaded through so a 200
+// response that declares Vary is stored under the same base key future
+// lookups will consult, rather than one recomputed without the active
+// cache-rules query policy.
+func (h *handler) revalidate(lw *loggingWriter, r *http.Request, urlKey, key string, ent *cache.EntryMeta, body io.ReadCloser, decision rules.Decision) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, targetURL(h.target, r), nil)
+	if err != nil {
+		h.writeFromEntry(lw, ent, body, "HIT")
+		return
+	}
+	req.Header = r.Header.Clone()
+	filterHopByHop(req.Header)
+	req.Host = h.target.Host
+	if etag := ent.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lm := ent.Header.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		cc := cache.ParseCacheControl(ent.Header)
+		if cc.MustRevalidate {
+			_ = body.Close()
+			http.Error(lw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		h.counters.recordHit()
+		h.writeFromEntry(lw, ent, body, "STALE")
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		filterHopByHop(res.Header)
+		for k, vv := range res.Header {
+			ent.Header[k] = vv
+		}
+		ent.StoredAt = time.Now()
+		_ = h.cache.UpdateMeta(key, ent)
+		h.counters.recordHit()
+		h.writeFromEntry(lw, ent, body, "REVALIDATED")
+		return
+	}
+
+	_ = body.Close()
+	h.counters.recordMiss()
+	h.storeAndWriteWithURLKey(lw, r, res, urlKey, key, "MISS", decision)
+}
+
+// fetchAndStore performs an uncached origin fetch, storing the response
+// under the appropriate variant key if it turns out to be cacheable.
+func (h *handler) fetchAndStore(lw *loggingWriter, r *http.Request, urlKey, key, cacheStatus string, decision rules.Decision) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL(h.target, r), nil)
+	if err != nil {
+		h.baseProxy.ServeHTTP(lw, r)
+		return
+	}
+	req.Header = r.Header.Clone()
+	filterHopByHop(req.Header)
+	req.Host = h.target.Host
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		log.Printf("proxy error: %v", err)
+		http.Error(lw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	h.storeAndWriteWithURLKey(lw, r, res, urlKey, key, cacheStatus, decision)
+}
+
+// storeAndWriteWithURLKey writes res to lw and, if cacheable, stores it,
+// streaming rather than buffering when the body is large or of unknown
+// length. When the response declares Vary, urlKey (if non-empty) is used to
+// update the per-URL variant index so future requests resolve to the right key.
+func (h *handler) storeAndWriteWithURLKey(lw *loggingWriter, r *http.Request, res *http.Response, urlKey, key, cacheStatus string, decision rules.Decision) {
+	filterHopByHop(res.Header)
+
+	if res.ContentLength < 0 || res.ContentLength > h.streamThreshold {
+		h.streamAndStore(lw, r, res, urlKey, key, cacheStatus, decision)
+		return
+	}
+	h.bufferAndStore(lw, r, res, urlKey, key, cacheStatus, decision)
+}
+
+// bufferAndStore reads a (small, known-length) response fully into memory
+// before storing and writing it.
+func (h *handler) bufferAndStore(lw *loggingWriter, r *http.Request, res *http.Response, urlKey, key, cacheStatus string, decision rules.Decision) {
+	limit := h.maxCacheableBody
+	b, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		http.Error(lw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	overflowed := int64(len(b)) > limit
+
+	resCC := cache.ParseCacheControl(res.Header)
+	vary := cache.VaryHeaders(res.Header.Get("Vary"))
+	cacheable := !overflowed && h.cache != nil && !resCC.NoStore && !resCC.Private && !cache.VaryAll(vary) && cache.IsCacheableStatus(res.StatusCode, res.Header)
+
+	if cacheable {
+		storeKey := h.resolveVaryKey(r, res, urlKey, key, vary)
+		meta := &cache.EntryMeta{
+			Status:         res.StatusCode,
+			Header:         cache.CloneHeaders(res.Header),
+			StoredAt:       time.Now(),
+			RequestHeaders: cache.SubsetHeaders(r.Header, vary),
+			URL:            targetURL(h.target, r),
+		}
+		if decision.TTL > 0 {
+			ttl := decision.TTL
+			meta.PolicyTTL = &ttl
+		}
+		_ = h.cache.Set(storeKey, meta, bytes.NewReader(b))
+	}
+
+	res.Header.Set("X-Cache", cacheStatus)
+	if overflowed {
+		res.Header.Del("Content-Length")
+	} else {
+		res.Header.Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	}
+	copyHeaders(lw.Header(), res.Header)
+	lw.WriteHeader(res.StatusCode)
+	_, _ = lw.Write(b)
+	if overflowed {
+		_, _ = io.Copy(lw, res.Body)
+	}
+}
+
+// streamAndStore tees a large or unknown-length response directly to the
+// client while simultaneously writing it to the cache, so it is never held
+// in memory whole. If the body turns out to exceed maxCacheableBody, the
+// cache write is aborted and its partial temp file discarded, but the client
+// stream is unaffected.
+func (h *handler) streamAndStore(lw *loggingWriter, r *http.Request, res *http.Response, urlKey, key, cacheStatus string, decision rules.Decision) {
+	resCC := cache.ParseCacheControl(res.Header)
+	vary := cache.VaryHeaders(res.Header.Get("Vary"))
+	cacheable := h.cache != nil && !resCC.NoStore && !resCC.Private && !cache.VaryAll(vary) && cache.IsCacheableStatus(res.StatusCode, res.Header)
+
+	storeKey := key
+	if cacheable {
+		storeKey = h.resolveVaryKey(r, res, urlKey, key, vary)
+	}
+
+	res.Header.Set("X-Cache", cacheStatus)
+	copyHeaders(lw.Header(), res.Header)
+	lw.WriteHeader(res.StatusCode)
+
+	if !cacheable {
+		_, _ = io.Copy(lw, res.Body)
+		return
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		meta := &cache.EntryMeta{
+			Status:         res.StatusCode,
+			Header:         cache.CloneHeaders(res.Header),
+			StoredAt:       time.Now(),
+			RequestHeaders: cache.SubsetHeaders(r.Header, vary),
+			URL:            targetURL(h.target, r),
+		}
+		if decision.TTL > 0 {
+			ttl := decision.TTL
+			meta.PolicyTTL = &ttl
+		}
+		if err := h.cache.Set(storeKey, meta, pr); err != nil && !errors.Is(err, errBodyTooLargeToCache) {
+			log.Printf("cache write error for %s: %v", requestLine(r), err)
+		}
+		_, _ = io.Copy(io.Discard, pr) // drain in case Set bailed early
+	}()
+
+	lcw := &limitWriter{w: pw, limit: h.maxCacheableBody}
+	_, copyErr := io.Copy(lw, io.TeeReader(res.Body, lcw))
+	switch {
+	case lcw.exceeded:
+		_ = pw.CloseWithError(errBodyTooLargeToCache)
+	case copyErr != nil:
+		// Client disconnected or the origin body errored mid-stream: the
+		// tee'd copy is a truncated prefix of the real response, so the
+		// cache write must be aborted rather than committed under the
+		// origin's full Content-Length.
+		_ = pw.CloseWithError(copyErr)
+	default:
+		_ = pw.Close()
+	}
+	<-done
+}
+
+// resolveVaryKey returns the key a response should be stored under, creating
+// and saving the URL's variant index first if the response declares Vary.
+func (h *handler) resolveVaryKey(r *http.Request, res *http.Response, urlKey, key string, vary []string) string {
+	if len(vary) == 0 {
+		return key
+	}
+	if urlKey == "" {
+		urlKey, _ = cache.HashURL(h.originBase, r)
+	}
+	storeKey := cache.VaryKey(urlKey, vary, r.Header)
+	h.saveVariant(urlKey, r, vary, storeKey)
+	return storeKey
+}
+
+func (h *handler) saveVariant(urlKey string, r *http.Request, vary []string, storeKey string) {
+	idx, ok, _ := h.cache.VariantIndex(urlKey)
+	if !ok {
+		idx = &cache.VariantIndex{}
+	}
+	if idx.Variants == nil {
+		idx.Variants = map[string]string{}
+	}
+	idx.Vary = vary
+	idx.Variants[cache.FingerprintVary(vary, r.Header)] = storeKey
+	_ = h.cache.SaveVariantIndex(urlKey, idx)
+}
+
+// limitWriter forwards writes to w until limit is exceeded, after which it
+// silently discards further data and marks itself exceeded. It never returns
+// an error, so wrapping it as a TeeReader target can't break the primary read.
+type limitWriter struct {
+	w        io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.exceeded {
+		return len(p), nil
+	}
+	l.written += int64(len(p))
+	if l.written > l.limit {
+		l.exceeded = true
+		return len(p), nil
+	}
+	if _, err := l.w.Write(p); err != nil {
+		l.exceeded = true
+	}
+	return len(p), nil
+}
+
+// writeFromEntry serves a stored entry, stamping the Age header per RFC 7234
+// §5.1. It takes ownership of body and closes it once written.
+func (h *handler) writeFromEntry(lw *loggingWriter, ent *cache.EntryMeta, body io.ReadCloser, cacheStatus string) {
+	defer body.Close()
+	copyHeaders(lw.Header(), ent.Header)
+	lw.Header().Set("Age", fmt.Sprintf("%d", int(cache.CurrentAge(ent).Seconds())))
+	lw.Header().Set("X-Cache", cacheStatus)
+	filterHopByHop(lw.Header())
+	lw.WriteHeader(ent.Status)
+	_, _ = io.Copy(lw, body)
+}
+
+func (h *handler) logRequest(r *http.Request, lw *loggingWriter, start time.Time) {
+	dur := time.Since(start)
+	status := lw.Header().Get("X-Cache")
+	if h.debug {
+		if status != "" {
+			log.Printf("%s %s -> %d %dB %s (%s)", r.Method, requestLine(r), lw.status, lw.bytes, dur, status)
+		} else {
+			log.Printf("%s %s -> %d %dB %s", r.Method, requestLine(r), lw.status, lw.bytes, dur)
+		}
+	} else {
+		log.Printf("%s %s -> %d %s", r.Method, requestLine(r), lw.status, dur)
+	}
+}
+
+func targetURL(target *url.URL, r *http.Request) string {
+	u := *target
+	u.Path = cache.JoinPath(target.Path, r.URL.Path)
+	u.RawQuery = r.URL.RawQuery
+	return u.String()
+}
+
 func newReverseProxy(target *url.URL) *httputil.ReverseProxy {
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
@@ -218,22 +812,3 @@ func copyHeaders(dst, src http.Header) {
 		}
 	}
 }
-
-func reqNoStore(r *http.Request) bool {
-	cc := r.Header.Get("Cache-Control")
-	return containsToken(cc, "no-store")
-}
-
-func resNoStore(res *http.Response) bool {
-	cc := res.Header.Get("Cache-Control")
-	return containsToken(cc, "no-store")
-}
-
-func containsToken(v, token string) bool {
-	for _, part := range strings.Split(v, ",") {
-		if strings.EqualFold(strings.TrimSpace(part), token) {
-			return true
-		}
-	}
-	return false
-}
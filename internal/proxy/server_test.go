@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"caching-proxy/internal/cache"
+)
+
+// TestFetchCoalesced_SingleUpstreamHit fires a burst of concurrent requests
+// for the same URL at an empty cache and asserts they share a single origin
+// fetch instead of each dialing out.
+func TestFetchCoalesced_SingleUpstreamHit(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	target, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := cache.NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handler{
+		originBase:       origin.URL,
+		target:           target,
+		cache:            dc,
+		baseProxy:        newReverseProxy(target),
+		client:           &http.Client{Timeout: 5 * time.Second},
+		coalesceTimeout:  5 * time.Second,
+		maxCoalesceBody:  8 << 20,
+		maxCacheableBody: 64 << 20,
+		streamThreshold:  1 << 20,
+		counters:         &adminCounters{},
+	}
+
+	const n = 200
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/widget", nil)
+			rec := httptest.NewRecorder()
+			h.serveHTTP(rec, req)
+		}()
+	}
+
+	// Give every goroutine time to either become the leader or join the
+	// in-flight call before the origin is allowed to respond, so they
+	// coalesce instead of racing the leader to completion.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("origin hit %d times, want exactly 1", got)
+	}
+}
+
+// TestFetchCoalesced_RespectsVary reproduces a cold-cache Vary mismatch: a
+// follower that coalesces onto a leader's in-flight fetch must not be served
+// the leader's representation unless its own Vary-relevant headers match.
+func TestFetchCoalesced_RespectsVary(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			// Hold the first (leader) request open so the second request has
+			// time to join it as a coalescing follower.
+			<-release
+		}
+		lang := r.Header.Get("Accept-Language")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("body-for-" + lang))
+	}))
+	defer origin.Close()
+
+	target, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := cache.NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handler{
+		originBase:       origin.URL,
+		target:           target,
+		cache:            dc,
+		baseProxy:        newReverseProxy(target),
+		client:           &http.Client{Timeout: 5 * time.Second},
+		coalesceTimeout:  5 * time.Second,
+		maxCoalesceBody:  8 << 20,
+		maxCacheableBody: 64 << 20,
+		streamThreshold:  1 << 20,
+		counters:         &adminCounters{},
+	}
+
+	var enBody, frBody string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Header.Set("Accept-Language", "en")
+		rec := httptest.NewRecorder()
+		h.serveHTTP(rec, req)
+		enBody = rec.Body.String()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Header.Set("Accept-Language", "fr")
+		rec := httptest.NewRecorder()
+		h.serveHTTP(rec, req)
+		frBody = rec.Body.String()
+	}()
+	// Give the fr request time to join the en request's in-flight call
+	// before letting the origin (and so the leader) proceed.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if enBody != "body-for-en" {
+		t.Errorf("en body = %q, want %q", enBody, "body-for-en")
+	}
+	if frBody != "body-for-fr" {
+		t.Errorf("fr body = %q, want %q", frBody, "body-for-fr")
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("origin hit %d times, want 2 (one per representation)", got)
+	}
+}
@@ -0,0 +1,94 @@
+package rules
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loadRules(t *testing.T, raw string) *Rules {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(raw), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Load(path, false)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return r
+}
+
+func TestMatchFirstRuleWins(t *testing.T) {
+	r := loadRules(t, `[
+		{"match": "^/repo/.*\\.deb$", "policy": "cache", "ttl": "720h"},
+		{"match": "^/repo/", "policy": "bypass"}
+	]`)
+
+	d := r.Match("/repo/pool/main/foo_1.0.deb")
+	if d.Policy != PolicyCache {
+		t.Errorf("policy = %s, want %s", d.Policy, PolicyCache)
+	}
+	if d.TTL != 720*time.Hour {
+		t.Errorf("ttl = %s, want 720h", d.TTL)
+	}
+	if d.MatchedRule != `^/repo/.*\.deb$` {
+		t.Errorf("matchedRule = %q", d.MatchedRule)
+	}
+}
+
+func TestMatchFallsThroughToLaterRule(t *testing.T) {
+	r := loadRules(t, `[
+		{"match": "^/repo/.*\\.deb$", "policy": "cache", "ttl": "720h"},
+		{"match": "^/repo/", "policy": "bypass"}
+	]`)
+
+	d := r.Match("/repo/Packages")
+	if d.Policy != PolicyBypass {
+		t.Errorf("policy = %s, want %s", d.Policy, PolicyBypass)
+	}
+}
+
+func TestMatchNoRuleMatches(t *testing.T) {
+	r := loadRules(t, `[{"match": "^/repo/", "policy": "bypass"}]`)
+
+	d := r.Match("/other")
+	if d.Policy != PolicyCache {
+		t.Errorf("policy = %s, want default %s", d.Policy, PolicyCache)
+	}
+	if d.MatchedRule != "" {
+		t.Errorf("matchedRule = %q, want empty", d.MatchedRule)
+	}
+}
+
+func TestMatchNilRulesReturnsDefault(t *testing.T) {
+	var r *Rules
+	d := r.Match("/anything")
+	if d.Policy != PolicyCache || d.MatchedRule != "" {
+		t.Errorf("Match on nil *Rules = %+v, want default decision", d)
+	}
+}
+
+func TestLoadRejectsInvalidPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	raw, _ := json.Marshal([]map[string]string{{"match": "^/", "policy": "evict"}})
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, false); err == nil {
+		t.Fatal("Load: want error for invalid policy, got nil")
+	}
+}
+
+func TestLoadRejectsInvalidPattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	raw, _ := json.Marshal([]map[string]string{{"match": "(unterminated", "policy": "bypass"}})
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, false); err == nil {
+		t.Fatal("Load: want error for invalid match pattern, got nil")
+	}
+}